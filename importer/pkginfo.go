@@ -3,10 +3,10 @@ package importer
 // TODO(gri): absorb this into go/types.
 
 import (
-	"code.google.com/p/go.tools/go/exact"
-	"code.google.com/p/go.tools/go/types"
 	"go/ast"
+	"go/constant"
 	"go/token"
+	"go/types"
 	"strconv"
 )
 
@@ -20,10 +20,42 @@ type PackageInfo struct {
 	Files []*ast.File // abstract syntax for the package's files
 
 	// Type-checker deductions.
-	types     map[ast.Expr]types.Type        // inferred types of expressions
-	constants map[ast.Expr]exact.Value       // values of constant expressions
-	idents    map[*ast.Ident]types.Object    // resolved objects for named entities
+	//
+	// Types records the type, constant value (if any) and addressing
+	// mode of every expression. Use the TypeAndValue predicates, e.g.
+	// info.Types[e].IsType(), IsValue(), IsVoid(), IsBuiltin(),
+	// Addressable(), Assignable(), HasOk(), to classify an expression
+	// instead of re-deriving that information by walking the AST.
+	Types map[ast.Expr]types.TypeAndValue
+
+	// Defs maps each declaring identifier to the object it defines
+	// (field, func, const, type, var or param). Defs[id] == nil for
+	// the blank identifier.
+	Defs map[*ast.Ident]types.Object
+
+	// Uses maps each referring (as opposed to declaring) identifier to
+	// the object it denotes.
+	Uses map[*ast.Ident]types.Object
+
+	// Selections maps each selector expression (other than a
+	// qualified identifier) to its selection, recording the kind of
+	// selection (FieldVal, MethodVal, MethodExpr), the index path
+	// through any embedded fields, and whether the receiver was
+	// implicitly indirected.
+	Selections map[*ast.SelectorExpr]*types.Selection
+
 	typecases map[*ast.CaseClause]*types.Var // implicit vars for single-type typecases
+
+	// Builtins caches the call-site-specific Signature of calls to
+	// built-in functions and unsafe pseudo-functions. It is not filled
+	// during type-checking: BuiltinCallSignature computes an entry on
+	// the first request for a call and stores it here.
+	Builtins map[*ast.CallExpr]*types.Signature
+
+	// Instances maps each Ident that denotes an instantiated generic
+	// function or type to the type arguments supplied (or inferred) at
+	// that use, and the resulting substituted type.
+	Instances map[*ast.Ident]types.Instance
 }
 
 // Imports returns the set of packages imported by this one, in source
@@ -42,45 +74,131 @@ func (info *PackageInfo) Imports() []*types.Package {
 			if path == "unsafe" {
 				continue // not a true package
 			}
-			typkg := info.Pkg.Imports()[path]
-			if seen[typkg] {
-				continue // already seen
+			for _, typkg := range info.Pkg.Imports() {
+				if typkg.Path() != path {
+					continue
+				}
+				if seen[typkg] {
+					break // already seen
+				}
+				seen[typkg] = true
+				imports = append(imports, typkg)
+				break
 			}
-			seen[typkg] = true
-			imports = append(imports, typkg)
 		}
 	}
 	return imports
 }
 
-// TypeOf returns the type of expression e.
+// TypeOf returns the type of expression e, or nil if the type-checker
+// recorded no information for e.
 // Precondition: e belongs to the package's ASTs.
 //
 func (info *PackageInfo) TypeOf(e ast.Expr) types.Type {
-	if t, ok := info.types[e]; ok {
-		return t
+	if tv, ok := info.Types[e]; ok {
+		return tv.Type
 	}
 	// Defining ast.Idents (id := expr) get only Ident callbacks
 	// but not Expr callbacks.
 	if id, ok := e.(*ast.Ident); ok {
-		return info.ObjectOf(id).Type()
+		if inst, ok := info.Instances[id]; ok {
+			return inst.Type // substituted type at the instantiation site
+		}
+		if obj := info.ObjectOf(id); obj != nil {
+			return obj.Type()
+		}
+	}
+	return nil
+}
+
+// TypeParamsOf returns the type parameter list of the generic function,
+// method or type declared by the entity that expression e denotes, or
+// nil if that entity is not generic.
+//
+// If e is an identifier, the type parameters are read off the
+// declaring/referring Object (via Defs/Uses) rather than TypeOf(e),
+// since TypeOf resolves through Instances to the substituted,
+// monomorphic type at an instantiation site, whose own TypeParams
+// are empty. This lets TypeParamsOf(id) be zipped with TypeArgsOf(id)
+// for the very id TypeArgsOf was built to describe.
+// Precondition: e belongs to the package's ASTs.
+//
+func (info *PackageInfo) TypeParamsOf(e ast.Expr) []*types.TypeParam {
+	if id, ok := e.(*ast.Ident); ok {
+		if obj := info.ObjectOf(id); obj != nil {
+			return typeParamList(obj.Type())
+		}
+	}
+	return typeParamList(info.TypeOf(e))
+}
+
+func typeParamList(t types.Type) []*types.TypeParam {
+	var tparams *types.TypeParamList
+	switch t := t.(type) {
+	case *types.Signature:
+		tparams = t.TypeParams()
+	case *types.Named:
+		tparams = t.TypeParams()
+	}
+	if tparams.Len() == 0 {
+		return nil
+	}
+	list := make([]*types.TypeParam, tparams.Len())
+	for i := range list {
+		list[i] = tparams.At(i)
+	}
+	return list
+}
+
+// TypeArgsOf returns the type arguments substituted for the type
+// parameters of the generic function or type instantiated at id, or
+// nil if id does not denote an instantiation.
+// Precondition: id belongs to the package's ASTs.
+//
+func (info *PackageInfo) TypeArgsOf(id *ast.Ident) []types.Type {
+	targs := info.Instances[id].TypeArgs
+	if targs.Len() == 0 {
+		return nil
+	}
+	list := make([]types.Type, targs.Len())
+	for i := range list {
+		list[i] = targs.At(i)
 	}
-	panic("no type for expression")
+	return list
 }
 
 // ValueOf returns the value of expression e if it is a constant, nil
 // otherwise.
 // Precondition: e belongs to the package's ASTs.
 //
-func (info *PackageInfo) ValueOf(e ast.Expr) exact.Value {
-	return info.constants[e]
+func (info *PackageInfo) ValueOf(e ast.Expr) constant.Value {
+	return info.Types[e].Value
 }
 
 // ObjectOf returns the typechecker object denoted by the specified id.
 // Precondition: id belongs to the package's ASTs.
 //
 func (info *PackageInfo) ObjectOf(id *ast.Ident) types.Object {
-	return info.idents[id]
+	if obj := info.Uses[id]; obj != nil {
+		return obj
+	}
+	return info.Defs[id]
+}
+
+// DefOf returns the object declared by id, or nil if id is not a
+// declaring identifier (or is the blank identifier).
+// Precondition: id belongs to the package's ASTs.
+//
+func (info *PackageInfo) DefOf(id *ast.Ident) types.Object {
+	return info.Defs[id]
+}
+
+// UseOf returns the object referred to by id, or nil if id is not a
+// referring identifier.
+// Precondition: id belongs to the package's ASTs.
+//
+func (info *PackageInfo) UseOf(id *ast.Ident) types.Object {
+	return info.Uses[id]
 }
 
 // IsType returns true iff expression e denotes a type.
@@ -89,23 +207,54 @@ func (info *PackageInfo) ObjectOf(id *ast.Ident) types.Object {
 // appearing in a SelectorExpr or declaration.
 //
 func (info *PackageInfo) IsType(e ast.Expr) bool {
-	switch e := e.(type) {
-	case *ast.SelectorExpr: // pkg.Type
-		if obj := info.IsPackageRef(e); obj != nil {
-			_, isType := obj.(*types.TypeName)
-			return isType
-		}
-	case *ast.StarExpr: // *T
-		return info.IsType(e.X)
-	case *ast.Ident:
-		_, isType := info.ObjectOf(e).(*types.TypeName)
-		return isType
-	case *ast.ArrayType, *ast.StructType, *ast.FuncType, *ast.InterfaceType, *ast.MapType, *ast.ChanType:
-		return true
-	case *ast.ParenExpr:
-		return info.IsType(e.X)
-	}
-	return false
+	return info.Types[e].IsType()
+}
+
+// IsValue returns true iff expression e denotes a value, i.e. not a
+// type, a builtin, or the void "result" of a call with no return
+// values.
+// Precondition: e belongs to the package's ASTs.
+//
+func (info *PackageInfo) IsValue(e ast.Expr) bool {
+	return info.Types[e].IsValue()
+}
+
+// IsVoid returns true iff expression e is a call of a function with
+// no return values.
+// Precondition: e belongs to the package's ASTs.
+//
+func (info *PackageInfo) IsVoid(e ast.Expr) bool {
+	return info.Types[e].IsVoid()
+}
+
+// IsBuiltin returns true iff expression e denotes a built-in function.
+// Precondition: e belongs to the package's ASTs.
+//
+func (info *PackageInfo) IsBuiltin(e ast.Expr) bool {
+	return info.Types[e].IsBuiltin()
+}
+
+// Addressable returns true iff expression e is addressable.
+// Precondition: e belongs to the package's ASTs.
+//
+func (info *PackageInfo) Addressable(e ast.Expr) bool {
+	return info.Types[e].Addressable()
+}
+
+// Assignable returns true iff expression e may be assigned to, i.e. it
+// is a variable or a map index expression.
+// Precondition: e belongs to the package's ASTs.
+//
+func (info *PackageInfo) Assignable(e ast.Expr) bool {
+	return info.Types[e].Assignable()
+}
+
+// HasOk returns true iff expression e may appear on the rhs of a
+// comma-ok assignment.
+// Precondition: e belongs to the package's ASTs.
+//
+func (info *PackageInfo) HasOk(e ast.Expr) bool {
+	return info.Types[e].HasOk()
 }
 
 // IsPackageRef returns the identity of the object if sel is a
@@ -114,14 +263,28 @@ func (info *PackageInfo) IsType(e ast.Expr) bool {
 // Precondition: sel belongs to the package's ASTs.
 //
 func (info *PackageInfo) IsPackageRef(sel *ast.SelectorExpr) types.Object {
+	// Qualified identifiers (pkg.X) have no entry in Selections;
+	// field and method selections always do.
+	if info.Selections[sel] != nil {
+		return nil
+	}
 	if id, ok := sel.X.(*ast.Ident); ok {
-		if pkg, ok := info.ObjectOf(id).(*types.Package); ok {
-			return pkg.Scope().Lookup(nil, sel.Sel.Name)
+		if pn, ok := info.ObjectOf(id).(*types.PkgName); ok {
+			return pn.Imported().Scope().Lookup(sel.Sel.Name)
 		}
 	}
 	return nil
 }
 
+// SelectionOf returns the selection denoted by the selector expression
+// sel, or nil if sel is a qualified identifier (pkg.X) rather than a
+// field or method selection.
+// Precondition: sel belongs to the package's ASTs.
+//
+func (info *PackageInfo) SelectionOf(sel *ast.SelectorExpr) *types.Selection {
+	return info.Selections[sel]
+}
+
 // TypeCaseVar returns the implicit variable created by a single-type
 // case clause in a type switch, or nil if not found.
 //
@@ -130,37 +293,101 @@ func (info *PackageInfo) TypeCaseVar(cc *ast.CaseClause) *types.Var {
 }
 
 var (
-	tEface      = new(types.Interface)
-	tComplex64  = types.Typ[types.Complex64]
-	tComplex128 = types.Typ[types.Complex128]
-	tFloat32    = types.Typ[types.Float32]
-	tFloat64    = types.Typ[types.Float64]
+	tEface         = new(types.Interface)
+	tComplex64     = types.Typ[types.Complex64]
+	tComplex128    = types.Typ[types.Complex128]
+	tFloat32       = types.Typ[types.Float32]
+	tFloat64       = types.Typ[types.Float64]
+	tInt           = types.Typ[types.Int]
+	tUnsafePointer = types.Typ[types.UnsafePointer]
 )
 
-// BuiltinCallSignature returns a new Signature describing the
-// effective type of a builtin operator for the particular call e.
-//
-// This requires ad-hoc typing rules for all variadic (append, print,
-// println) and polymorphic (append, copy, delete, close) built-ins.
-// This logic could be part of the typechecker, and should arguably
-// be moved there and made accessible via an additional types.Context
-// callback.
+// BuiltinCallSignature returns the Signature describing the effective
+// type of the builtin or unsafe pseudo-function called by e, computed
+// by builtinSignature from the already-recorded types of e's actual
+// arguments and cached in info.Builtins keyed by the call expression,
+// or nil if e is not such a call.
 //
-// The returned Signature is degenerate and only intended for use by
-// emitCallArgs.
+// The returned Signature is degenerate (it carries no result type)
+// and is only intended for use by emitCallArgs.
 //
 func (info *PackageInfo) BuiltinCallSignature(e *ast.CallExpr) *types.Signature {
+	if sig, ok := info.Builtins[e]; ok {
+		return sig
+	}
+	if _, ok := info.builtinName(e); !ok {
+		return nil
+	}
+	argTypes := make([]types.Type, len(e.Args))
+	for i, arg := range e.Args {
+		argTypes[i] = info.TypeOf(arg)
+	}
+	sig := info.builtinSignature(e, argTypes)
+	if info.Builtins == nil {
+		info.Builtins = make(map[*ast.CallExpr]*types.Signature)
+	}
+	info.Builtins[e] = sig
+	return sig
+}
+
+// builtinName returns the name of the built-in function or unsafe
+// pseudo-function called by e (e.g. "append" or "unsafe.Sizeof"), and
+// true; or ("", false) if e does not call one.
+//
+func (info *PackageInfo) builtinName(e *ast.CallExpr) (string, bool) {
+	switch fun := unparen(e.Fun).(type) {
+	case *ast.Ident:
+		// An identifier that resolves to anything other than a
+		// built-in (a func, a type in a conversion, a shadowing var)
+		// is not a built-in call; an unresolved one is taken as one.
+		if obj := info.ObjectOf(fun); obj != nil {
+			if _, ok := obj.(*types.Builtin); !ok {
+				return "", false
+			}
+		}
+		return fun.Name, true
+	case *ast.SelectorExpr:
+		// Resolve the qualifier to the object it denotes rather than
+		// comparing the local (possibly renamed) identifier text, so
+		// e.g. `import u "unsafe"; u.Sizeof(x)` is still recognized.
+		if id, ok := fun.X.(*ast.Ident); ok {
+			if pn, ok := info.ObjectOf(id).(*types.PkgName); ok && pn.Imported().Path() == "unsafe" {
+				// unsafe.Pointer(p) is a conversion, not a call.
+				if obj := info.ObjectOf(fun.Sel); obj != nil {
+					if _, ok := obj.(*types.Builtin); !ok {
+						return "", false
+					}
+				}
+				return "unsafe." + fun.Sel.Name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// builtinSignature implements the ad-hoc typing rules for all
+// variadic (append, print, println) and polymorphic (append, copy,
+// delete, close, new, make, unsafe.*) built-ins, deriving each
+// parameter's type from argTypes, the types of e's actual arguments
+// as already computed by the type-checker.
+//
+func (info *PackageInfo) builtinSignature(e *ast.CallExpr, argTypes []types.Type) *types.Signature {
 	var params []*types.Var
 	var isVariadic bool
 
-	switch builtin := unparen(e.Fun).(*ast.Ident).Name; builtin {
+	builtin, ok := info.builtinName(e)
+	if !ok {
+		panic("not a builtin or unsafe call")
+	}
+
+	switch builtin {
 	case "append":
-		var t0, t1 types.Type
-		t0 = info.TypeOf(e) // infer arg[0] type from result type
+		t0 := argTypes[0]
+		var t1 types.Type
 		if e.Ellipsis != 0 {
 			// append([]T, []T) []T
 			// append([]byte, string) []byte
-			t1 = info.TypeOf(e.Args[1]) // no conversion
+			t1 = argTypes[1] // no conversion
 		} else {
 			// append([]T, ...T) []T
 			t1 = t0.Underlying().(*types.Slice).Elem()
@@ -174,19 +401,19 @@ func (info *PackageInfo) BuiltinCallSignature(e *ast.CallExpr) *types.Signature
 		isVariadic = true
 		// Note, arg0 may have any type, not necessarily tEface.
 		params = append(params,
-			types.NewVar(token.NoPos, nil, "", info.TypeOf(e.Args[0])),
+			types.NewVar(token.NoPos, nil, "", argTypes[0]),
 			types.NewVar(token.NoPos, nil, "", tEface))
 
 	case "close":
-		params = append(params, types.NewVar(token.NoPos, nil, "", info.TypeOf(e.Args[0])))
+		params = append(params, types.NewVar(token.NoPos, nil, "", argTypes[0]))
 
 	case "copy":
 		// copy([]T, []T) int
 		// Infer arg types from each other.  Sleazy.
 		var st *types.Slice
-		if t, ok := info.TypeOf(e.Args[0]).Underlying().(*types.Slice); ok {
+		if t, ok := argTypes[0].Underlying().(*types.Slice); ok {
 			st = t
-		} else if t, ok := info.TypeOf(e.Args[1]).Underlying().(*types.Slice); ok {
+		} else if t, ok := argTypes[1].Underlying().(*types.Slice); ok {
 			st = t
 		} else {
 			panic("cannot infer types in call to copy()")
@@ -196,41 +423,33 @@ func (info *PackageInfo) BuiltinCallSignature(e *ast.CallExpr) *types.Signature
 
 	case "delete":
 		// delete(map[K]V, K)
-		tmap := info.TypeOf(e.Args[0])
+		tmap := argTypes[0]
 		tkey := tmap.Underlying().(*types.Map).Key()
 		params = append(params,
 			types.NewVar(token.NoPos, nil, "", tmap),
 			types.NewVar(token.NoPos, nil, "", tkey))
 
 	case "len", "cap":
-		params = append(params, types.NewVar(token.NoPos, nil, "", info.TypeOf(e.Args[0])))
+		params = append(params, types.NewVar(token.NoPos, nil, "", argTypes[0]))
 
 	case "real", "imag":
-		// Reverse conversion to "complex" case below.
-		var argType types.Type
-		switch info.TypeOf(e).(*types.Basic).Kind() {
-		case types.UntypedFloat:
-			argType = types.Typ[types.UntypedComplex]
-		case types.Float64:
-			argType = tComplex128
-		case types.Float32:
-			argType = tComplex64
-		default:
-			unreachable()
-		}
-		params = append(params, types.NewVar(token.NoPos, nil, "", argType))
+		params = append(params, types.NewVar(token.NoPos, nil, "", argTypes[0]))
 
 	case "complex":
-		var argType types.Type
-		switch info.TypeOf(e).(*types.Basic).Kind() {
-		case types.UntypedComplex:
-			argType = types.Typ[types.UntypedFloat]
-		case types.Complex128:
-			argType = tFloat64
-		case types.Complex64:
-			argType = tFloat32
-		default:
-			unreachable()
+		// The two operands may be constants of different untyped
+		// kinds (e.g. complex(1, 2.5)); the spec requires both to be
+		// converted to a single common component type. Widen across
+		// argTypes rather than consulting the call's own result type.
+		argType := types.Typ[types.UntypedFloat]
+		for _, t := range argTypes[:2] {
+			switch t.Underlying().(*types.Basic).Kind() {
+			case types.Float64:
+				argType = tFloat64
+			case types.Float32:
+				if argType != tFloat64 {
+					argType = tFloat32
+				}
+			}
 		}
 		v := types.NewVar(token.NoPos, nil, "", argType)
 		params = append(params, v, v)
@@ -241,9 +460,57 @@ func (info *PackageInfo) BuiltinCallSignature(e *ast.CallExpr) *types.Signature
 	case "recover":
 		// no params
 
+	case "new":
+		// new(T) *T — T is a type, not a value; nothing to convert.
+
+	case "make":
+		// make(T, n)    — slice, map, chan (size/buffer capacity)
+		// make(T, n, m) — slice only (length, capacity)
+		switch argTypes[0].Underlying().(type) {
+		case *types.Slice, *types.Map, *types.Chan,
+			*types.Interface: // type parameter; its core type is one of the above
+			for range e.Args[1:] {
+				params = append(params, types.NewVar(token.NoPos, nil, "", tInt))
+			}
+		default:
+			unreachable()
+		}
+
+	case "unsafe.Sizeof", "unsafe.Alignof", "unsafe.Offsetof":
+		params = append(params, types.NewVar(token.NoPos, nil, "", argTypes[0]))
+
+	case "unsafe.Add":
+		// unsafe.Add(ptr unsafe.Pointer, len IntegerType) unsafe.Pointer
+		params = append(params,
+			types.NewVar(token.NoPos, nil, "", tUnsafePointer),
+			types.NewVar(token.NoPos, nil, "", argTypes[1]))
+
+	case "unsafe.Slice":
+		// unsafe.Slice(ptr *T, len IntegerType) []T
+		params = append(params,
+			types.NewVar(token.NoPos, nil, "", argTypes[0]),
+			types.NewVar(token.NoPos, nil, "", argTypes[1]))
+
 	default:
 		panic("unknown builtin: " + builtin)
 	}
 
 	return types.NewSignature(nil, types.NewTuple(params...), nil, isVariadic)
-}
\ No newline at end of file
+}
+
+// unparen returns e with any enclosing parentheses stripped.
+func unparen(e ast.Expr) ast.Expr {
+	for {
+		p, ok := e.(*ast.ParenExpr)
+		if !ok {
+			return e
+		}
+		e = p.X
+	}
+}
+
+// unreachable panics; it marks a case that cannot arise if the
+// type-checker has already accepted the program.
+func unreachable() {
+	panic("unreachable")
+}
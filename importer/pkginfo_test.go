@@ -0,0 +1,123 @@
+package importer
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"testing"
+)
+
+// complex(1, 2.5) mixes an untyped int and an untyped float operand;
+// both must be converted to a single common component type, not left
+// as the two distinct argTypes the checker reports for each operand.
+func TestBuiltinSignatureComplexMixedKinds(t *testing.T) {
+	expr, err := parser.ParseExpr("complex(1, 2.5)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	call := expr.(*ast.CallExpr)
+
+	info := &PackageInfo{}
+	argTypes := []types.Type{types.Typ[types.UntypedInt], types.Typ[types.UntypedFloat]}
+
+	sig := info.builtinSignature(call, argTypes)
+
+	p0, p1 := sig.Params().At(0).Type(), sig.Params().At(1).Type()
+	if p0 != p1 {
+		t.Fatalf("complex() params have different types: %v, %v", p0, p1)
+	}
+	if want := types.Typ[types.UntypedFloat]; p0 != want {
+		t.Errorf("complex() param type = %v, want %v", p0, want)
+	}
+}
+
+// complex(x, 2.5), where x is a typed float64, must widen the untyped
+// operand to float64 rather than leaving the mismatched pair.
+func TestBuiltinSignatureComplexTypedOperand(t *testing.T) {
+	expr, err := parser.ParseExpr("complex(x, 2.5)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	call := expr.(*ast.CallExpr)
+
+	info := &PackageInfo{}
+	argTypes := []types.Type{types.Typ[types.Float64], types.Typ[types.UntypedFloat]}
+
+	sig := info.builtinSignature(call, argTypes)
+
+	p0, p1 := sig.Params().At(0).Type(), sig.Params().At(1).Type()
+	if p0 != p1 {
+		t.Fatalf("complex() params have different types: %v, %v", p0, p1)
+	}
+	if want := types.Typ[types.Float64]; p0 != want {
+		t.Errorf("complex() param type = %v, want %v", p0, want)
+	}
+}
+
+// complex(x, 2.5), where x has a named type whose underlying type is
+// float32, must see through the Named wrapper rather than panicking.
+func TestBuiltinSignatureComplexNamedOperand(t *testing.T) {
+	expr, err := parser.ParseExpr("complex(x, 2.5)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	call := expr.(*ast.CallExpr)
+
+	named := types.NewNamed(types.NewTypeName(token.NoPos, nil, "F32", nil), types.Typ[types.Float32], nil)
+
+	info := &PackageInfo{}
+	argTypes := []types.Type{named, types.Typ[types.UntypedFloat]}
+
+	sig := info.builtinSignature(call, argTypes)
+
+	p0, p1 := sig.Params().At(0).Type(), sig.Params().At(1).Type()
+	if p0 != p1 {
+		t.Fatalf("complex() params have different types: %v, %v", p0, p1)
+	}
+	if want := types.Typ[types.Float32]; p0 != want {
+		t.Errorf("complex() param type = %v, want %v", p0, want)
+	}
+}
+
+// u.Sizeof(x), with unsafe imported under a local name, must still be
+// recognized as a call to the unsafe package, not just to something
+// named "unsafe".
+func TestBuiltinNameRenamedUnsafeImport(t *testing.T) {
+	const src = `package p
+import u "unsafe"
+var x int
+var _ = u.Sizeof(x)
+`
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "p.go", src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var call *ast.CallExpr
+	var qualifier *ast.Ident
+	ast.Inspect(file, func(n ast.Node) bool {
+		if c, ok := n.(*ast.CallExpr); ok {
+			if sel, ok := c.Fun.(*ast.SelectorExpr); ok && sel.Sel.Name == "Sizeof" {
+				call = c
+				qualifier = sel.X.(*ast.Ident)
+			}
+		}
+		return true
+	})
+	if call == nil {
+		t.Fatal("u.Sizeof(x) call not found")
+	}
+
+	unsafePkg := types.NewPackage("unsafe", "unsafe")
+	pkgName := types.NewPkgName(token.NoPos, nil, "u", unsafePkg)
+	info := &PackageInfo{
+		Uses: map[*ast.Ident]types.Object{qualifier: pkgName},
+	}
+
+	name, ok := info.builtinName(call)
+	if !ok || name != "unsafe.Sizeof" {
+		t.Errorf("builtinName(u.Sizeof(x)) = %q, %v; want %q, true", name, ok, "unsafe.Sizeof")
+	}
+}